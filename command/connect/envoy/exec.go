@@ -0,0 +1,241 @@
+// +build linux darwin freebsd
+
+package envoy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// ConfigDeliveryMode selects how execEnvoy gets the rendered bootstrap JSON
+// in front of Envoy.
+type ConfigDeliveryMode int
+
+const (
+	// ConfigDeliveryAuto picks ConfigDeliveryFD where /dev/fd is known to
+	// work and falls back to ConfigDeliveryTempFile otherwise. It's the
+	// zero value so a bare ExecOpts{} always does the right thing.
+	ConfigDeliveryAuto ConfigDeliveryMode = iota
+
+	// ConfigDeliveryFD passes the bootstrap over an inherited pipe fd
+	// exposed to Envoy as /dev/fd/3. This is the cheapest option but
+	// requires /dev/fd to be mounted, which isn't guaranteed on FreeBSD
+	// without fdescfs(5).
+	ConfigDeliveryFD
+
+	// ConfigDeliveryTempFile writes the bootstrap to a 0600 temp file and
+	// passes its path to Envoy, removing it again once Envoy is done with
+	// it (or immediately if it never started).
+	ConfigDeliveryTempFile
+)
+
+// ExecOpts customizes how execEnvoy starts the Envoy child.
+type ExecOpts struct {
+	// Mode selects how the bootstrap config is delivered. The zero value,
+	// ConfigDeliveryAuto, detects the best mechanism for the current
+	// platform.
+	Mode ConfigDeliveryMode
+
+	// AdminAddr is Envoy's admin listener (host:port). In
+	// ConfigDeliveryTempFile mode it's polled via the /ready endpoint so
+	// the temp file can be unlinked as soon as Envoy has parsed it rather
+	// than only once Envoy exits. It's ignored in ConfigDeliveryFD mode
+	// and optional in ConfigDeliveryTempFile mode - if empty the temp
+	// file is simply removed once the command returns.
+	AdminAddr string
+
+	// ReadyTimeout bounds how long ConfigDeliveryTempFile mode waits on
+	// AdminAddr's /ready endpoint before giving up and falling back to
+	// removing the temp file once Envoy exits. Defaults to 10s.
+	ReadyTimeout time.Duration
+}
+
+// detectConfigDeliveryMode picks ConfigDeliveryFD if /dev/fd looks usable on
+// this host and ConfigDeliveryTempFile otherwise. This is what lets the same
+// binary work unmodified on Linux/Darwin (where /dev/fd is always present)
+// and on FreeBSD (where it's only present if fdescfs is mounted).
+func detectConfigDeliveryMode() ConfigDeliveryMode {
+	if runtime.GOOS == "freebsd" {
+		if fi, err := os.Stat("/dev/fd"); err == nil && fi.IsDir() {
+			return ConfigDeliveryFD
+		}
+		return ConfigDeliveryTempFile
+	}
+	return ConfigDeliveryFD
+}
+
+// execEnvoy run the envoy binary given curArgs and envoyArgs. curArgs is
+// separated out because on darwin and linux it's necessary to pass the
+// current pid/state along to a the exec'd process for our tests to pass. In
+// the future it may be used to allow a future hot-restart mechanism to
+// re-invoke itself correctly.
+//
+// This blocks until the Envoy process exits and is only suitable for the
+// simple case where Consul execs exactly one Envoy for the lifetime of the
+// wrapper process. See Supervisor for the hot-restart-aware alternative that
+// keeps the previous epoch running while a new one boots (Supervisor always
+// uses ConfigDeliveryFD since its epochs are short-lived and Linux/Darwin
+// only).
+func execEnvoy(binaryName string, curArgs, envoyArgs []string, bootstrapJson []byte, opts ExecOpts) error {
+	mode := opts.Mode
+	if mode == ConfigDeliveryAuto {
+		mode = detectConfigDeliveryMode()
+	}
+
+	if mode == ConfigDeliveryTempFile {
+		return execEnvoyTempFile(binaryName, curArgs, envoyArgs, bootstrapJson, opts)
+	}
+	return execEnvoyFD(binaryName, curArgs, envoyArgs, bootstrapJson)
+}
+
+// execEnvoyFD delivers the bootstrap over an inherited pipe fd exposed to
+// Envoy as /dev/fd/3.
+func execEnvoyFD(binaryName string, curArgs, envoyArgs []string, bootstrapJson []byte) error {
+	cmd, pipeR, pipeW, err := buildEnvoyCmd(binaryName, curArgs, []string{"--disable-hot-restart"}, envoyArgs, bootstrapJson)
+	if err != nil {
+		return err
+	}
+
+	startErr := cmd.Start()
+	// The child has its own copy of the read end once Start returns (or
+	// never will, if Start failed), so our copy must be closed either way.
+	pipeR.Close()
+	if startErr != nil {
+		pipeW.Close()
+		return startErr
+	}
+	feedBootstrap(pipeW, bootstrapJson)
+
+	return cmd.Wait()
+}
+
+// execEnvoyTempFile delivers the bootstrap via a 0600 temp file, unlinking
+// it once Envoy has parsed it (detected by polling opts.AdminAddr's /ready
+// endpoint if set) or as soon as the command returns otherwise.
+func execEnvoyTempFile(binaryName string, curArgs, envoyArgs []string, bootstrapJson []byte, opts ExecOpts) error {
+	f, err := ioutil.TempFile("", "consul-envoy-bootstrap-*.json")
+	if err != nil {
+		return err
+	}
+	cleanup := func() { os.Remove(f.Name()) }
+
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		cleanup()
+		return err
+	}
+	if _, err := f.Write(bootstrapJson); err != nil {
+		f.Close()
+		cleanup()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		cleanup()
+		return err
+	}
+
+	args := make([]string, 0, len(curArgs)+4+len(envoyArgs))
+	args = append(args, curArgs...)
+	args = append(args, "--v2-config-only", "--disable-hot-restart", "--config-path", f.Name())
+	args = append(args, envoyArgs...)
+
+	cmd := exec.Command(binaryName, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		cleanup()
+		return err
+	}
+
+	if opts.AdminAddr != "" {
+		timeout := opts.ReadyTimeout
+		if timeout <= 0 {
+			timeout = 10 * time.Second
+		}
+		go func() {
+			if waitEnvoyReady(opts.AdminAddr, timeout) == nil {
+				cleanup()
+			}
+		}()
+	}
+
+	err = cmd.Wait()
+	cleanup()
+	return err
+}
+
+// waitEnvoyReady polls Envoy's admin /ready endpoint at addr until it
+// responds successfully or timeout elapses, so callers can tell when it's
+// safe to remove a temp file Envoy was still reading from.
+func waitEnvoyReady(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	url := fmt.Sprintf("http://%s/ready", addr)
+
+	for {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for envoy admin %q to become ready", addr)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// buildEnvoyCmd assembles, but does not start, an *exec.Cmd that will run
+// Envoy with bootstrapJson made available on the conventional /dev/fd/3
+// path. restartArgs is inserted immediately after --v2-config-only, which is
+// where --disable-hot-restart appears for a plain execEnvoyFD invocation and
+// where --restart-epoch appears for a Supervisor-managed one; the two are
+// mutually exclusive so callers only ever set one of them.
+//
+// buildEnvoyCmd does not close pipeR itself: cmd.ExtraFiles only holds a
+// reference to it, so closing it before the caller's cmd.Start() forks the
+// child would leave Envoy inheriting an already-closed fd 3. The caller is
+// responsible for closing pipeR once cmd.Start() returns (successfully or
+// not) and for calling feedBootstrap on pipeW (or closing it if the command
+// failed to start).
+func buildEnvoyCmd(binaryName string, curArgs, restartArgs, envoyArgs []string, bootstrapJson []byte) (cmd *exec.Cmd, pipeR, pipeW *os.File, err error) {
+	pipeR, pipeW, err = os.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	args := make([]string, 0, len(curArgs)+3+len(restartArgs)+len(envoyArgs))
+	args = append(args, curArgs...)
+	args = append(args, "--v2-config-only")
+	args = append(args, restartArgs...)
+	args = append(args, "--config-path", "/dev/fd/3")
+	args = append(args, envoyArgs...)
+
+	cmd = exec.Command(binaryName, args...)
+	cmd.ExtraFiles = []*os.File{pipeR}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd, pipeR, pipeW, nil
+}
+
+// feedBootstrap writes bootstrapJson to pipeW and closes it so that Envoy,
+// which inherited the read end as fd 3, sees EOF once the config has been
+// fully delivered. It must only be called after the owning *exec.Cmd has
+// either been started (so the child has its own copy of the read end) or
+// failed to start (so there's nothing left to feed).
+func feedBootstrap(pipeW *os.File, bootstrapJson []byte) {
+	go func() {
+		defer pipeW.Close()
+		io.Copy(pipeW, bytes.NewReader(bootstrapJson))
+	}()
+}
@@ -1,4 +1,4 @@
-// +build linux darwin
+// +build linux darwin freebsd
 
 package envoy
 
@@ -8,42 +8,93 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
+// TestExecEnvoy covers both config delivery modes: ConfigDeliveryFD (the
+// default on Linux/Darwin and on FreeBSD with fdescfs mounted) and
+// ConfigDeliveryTempFile (the fallback used where /dev/fd isn't available).
+// Both are driven through the same exec-fake-envoy helper so the argv and
+// bootstrap-survives-an-exec assertions are identical; only the expected
+// shape of the config path differs.
 func TestExecEnvoy(t *testing.T) {
-	require := require.New(t)
+	tests := []struct {
+		name           string
+		mode           string
+		wantPathRegexp string
+	}{
+		// "fd" is ConfigDeliveryFD, the default on Linux, Darwin, and
+		// FreeBSD-with-fdescfs; it must keep passing here since it's what
+		// auto-detection picks on every platform other than a bare FreeBSD.
+		{"fd", "fd", `^/dev/fd/\d+$`},
+		{"tempfile", "tempfile", `^.*consul-envoy-bootstrap.*\.json$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+
+			cmd, destroy := helperProcess("exec-fake-envoy", tt.mode)
+			defer destroy()
+
+			cmd.Stderr = os.Stderr
+			outBytes, err := cmd.Output()
+			require.NoError(err)
+
+			var got FakeEnvoyExecData
+			require.NoError(json.Unmarshal(outBytes, &got))
+
+			expectArgs := []string{
+				"--v2-config-only",
+				"--disable-hot-restart",
+				"--config-path",
+				// Different modes/platforms produce different config paths here
+				// so we use the value we got back. This is somewhat tautological
+				// but we do sanity check that value further below.
+				got.ConfigPath,
+				"--fake-envoy-arg",
+			}
+
+			require.Equal(expectArgs, got.Args)
+			require.Equal(fakeEnvoyTestData, got.ConfigData)
+			require.Regexp(tt.wantPathRegexp, got.ConfigPath)
 
-	cmd, destroy := helperProcess("exec-fake-envoy")
-	defer destroy()
-
-	cmd.Stderr = os.Stderr
-	outBytes, err := cmd.Output()
-	require.NoError(err)
-
-	var got FakeEnvoyExecData
-	require.NoError(json.Unmarshal(outBytes, &got))
-
-	expectArgs := []string{
-		"--v2-config-only",
-		"--disable-hot-restart",
-		"--config-path",
-		// Different platforms produce different file descriptors here so we use the
-		// value we got back. This is somewhat tautological but we do sanity check
-		// that value further below.
-		got.ConfigPath,
-		"--fake-envoy-arg",
+			if tt.mode == "tempfile" {
+				// execEnvoyTempFile must clean up after the child exits.
+				_, err := os.Stat(got.ConfigPath)
+				require.True(os.IsNotExist(err), "temp bootstrap file should be removed after Envoy exits")
+			}
+		})
 	}
-	expectConfigData := fakeEnvoyTestData
+}
+
+// TestExecEnvoyTempFileCleanupOnStartFailure verifies that a temp bootstrap
+// file is removed even when the Envoy binary itself fails to start, not just
+// when it exits normally.
+func TestExecEnvoyTempFileCleanupOnStartFailure(t *testing.T) {
+	require := require.New(t)
+
+	before := globBootstrapTempFiles(t)
 
-	require.Equal(expectArgs, got.Args)
-	require.Equal(expectConfigData, got.ConfigData)
-	// Sanity check the config path in a non-brittle way since we used it to
-	// generate expectation for the args.
-	require.Regexp(`^/dev/fd/\d+$`, got.ConfigPath)
+	err := execEnvoy("/does/not/exist/envoy-binary", nil, nil, []byte(fakeEnvoyTestData),
+		ExecOpts{Mode: ConfigDeliveryTempFile})
+	require.Error(err)
+
+	after := globBootstrapTempFiles(t)
+	require.Equal(before, after)
+}
+
+func globBootstrapTempFiles(t *testing.T) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(os.TempDir(), "consul-envoy-bootstrap-*.json"))
+	require.NoError(t, err)
+	return matches
 }
 
 type FakeEnvoyExecData struct {
@@ -103,6 +154,11 @@ func TestHelperProcess(t *testing.T) {
 
 		limitProcessLifetime(2 * time.Minute)
 
+		opts := ExecOpts{Mode: ConfigDeliveryFD}
+		if len(args) > 0 && args[0] == "tempfile" {
+			opts.Mode = ConfigDeliveryTempFile
+		}
+
 		err := execEnvoy(
 			os.Args[0],
 			[]string{
@@ -113,6 +169,7 @@ func TestHelperProcess(t *testing.T) {
 			},
 			[]string{"--fake-envoy-arg"},
 			[]byte(fakeEnvoyTestData),
+			opts,
 		)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "fake envoy process failed to exec: %v\n", err)
@@ -124,44 +181,62 @@ func TestHelperProcess(t *testing.T) {
 		// survived an exec.
 
 		limitProcessLifetime(2 * time.Minute)
+		reportFakeEnvoyExec(args)
+
+	case "fake-envoy-block":
+		// Same as fake-envoy, but stays up until sent SIGTERM instead of
+		// exiting the instant it's reported its bootstrap. Real Envoy
+		// keeps running (draining connections) after a hot-restart epoch
+		// hands off, so Supervisor's epoch bookkeeping and SIGTERM-driven
+		// draining need a double that actually stays alive to exercise.
+		limitProcessLifetime(2 * time.Minute)
+		reportFakeEnvoyExec(args)
 
-		data := FakeEnvoyExecData{
-			Args: args,
-		}
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGTERM)
+		<-sigCh
 
-		// Dump all of the args.
-		var captureNext bool
-		for _, arg := range args {
-			if arg == "--config-path" {
-				captureNext = true
-			} else if captureNext {
-				data.ConfigPath = arg
-				captureNext = false
-			}
-		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %q\n", cmd)
+		os.Exit(2)
+	}
+}
 
-		if data.ConfigPath == "" {
-			fmt.Fprintf(os.Stderr, "did not detect a --config-path argument passed through\n")
-			os.Exit(1)
-		}
+// reportFakeEnvoyExec dumps the argv a fake-envoy process was exec'd with,
+// plus the contents of whatever file its --config-path argument points at,
+// to stdout as JSON so the test driving it can assert on both.
+func reportFakeEnvoyExec(args []string) {
+	data := FakeEnvoyExecData{
+		Args: args,
+	}
 
-		d, err := ioutil.ReadFile(data.ConfigPath)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "could not read provided --config-path file %q: %v\n", data.ConfigPath, err)
-			os.Exit(1)
+	// Dump all of the args.
+	var captureNext bool
+	for _, arg := range args {
+		if arg == "--config-path" {
+			captureNext = true
+		} else if captureNext {
+			data.ConfigPath = arg
+			captureNext = false
 		}
-		data.ConfigData = string(d)
+	}
 
-		enc := json.NewEncoder(os.Stdout)
-		if err := enc.Encode(&data); err != nil {
-			fmt.Fprintf(os.Stderr, "could not dump results to stdout: %v", err)
-			os.Exit(1)
+	if data.ConfigPath == "" {
+		fmt.Fprintf(os.Stderr, "did not detect a --config-path argument passed through\n")
+		os.Exit(1)
+	}
 
-		}
+	d, err := ioutil.ReadFile(data.ConfigPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read provided --config-path file %q: %v\n", data.ConfigPath, err)
+		os.Exit(1)
+	}
+	data.ConfigData = string(d)
 
-	default:
-		fmt.Fprintf(os.Stderr, "Unknown command: %q\n", cmd)
-		os.Exit(2)
+	enc := json.NewEncoder(os.Stdout)
+	if err := enc.Encode(&data); err != nil {
+		fmt.Fprintf(os.Stderr, "could not dump results to stdout: %v", err)
+		os.Exit(1)
 	}
 }
 
@@ -0,0 +1,201 @@
+// +build linux darwin
+
+package envoy
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/consul/connect/proxy"
+)
+
+// BootstrapFunc renders the Envoy bootstrap JSON that should be used to
+// start the given epoch. It is injected into Supervisor rather than baked in
+// so tests can avoid needing a real xDS/Connect setup.
+type BootstrapFunc func(cfg *proxy.Config, epoch int) ([]byte, error)
+
+// runningEnvoy tracks a single live (or draining) Envoy child process.
+type runningEnvoy struct {
+	epoch int
+	cmd   *os.Process
+}
+
+// Supervisor keeps a single logical Envoy proxy alive across config changes
+// delivered by a proxy.ConfigWatcher. Each new *proxy.Config bumps Envoy's
+// hot-restart epoch, so the new process can take over listening sockets
+// from the previous one via Envoy's own shared-memory RPC mechanism, and the
+// previous epoch is only sent SIGTERM once DrainTime has elapsed. This gives
+// bootstrap/listener config changes a zero-downtime rollout without Consul
+// having to understand Envoy's draining protocol itself.
+type Supervisor struct {
+	// BinaryName is the envoy binary (or test double) to exec.
+	BinaryName string
+	// CurArgs are passed through before the flags Supervisor manages,
+	// mirroring execEnvoy's curArgs. It's only needed so tests can re-exec
+	// the test binary itself in place of a real Envoy.
+	CurArgs []string
+	// ExtraArgs are passed through to every Envoy invocation, after the
+	// flags Supervisor itself manages.
+	ExtraArgs []string
+	// DrainTime is how long the previous epoch is given to drain its
+	// connections before it is sent SIGTERM.
+	DrainTime time.Duration
+	// Watcher supplies new configs to restart Envoy with.
+	Watcher proxy.ConfigWatcher
+	// Bootstrap renders the bootstrap JSON for a given config and epoch.
+	Bootstrap BootstrapFunc
+	// Logger receives progress messages about epoch starts, drains, and
+	// exits. Envoy's own stdout/stderr are inherited directly (see
+	// buildEnvoyCmd) and are not routed through Logger.
+	Logger *log.Logger
+
+	mu        sync.Mutex
+	epochs    map[int]*runningEnvoy
+	nextEpoch int
+}
+
+// NewSupervisor creates a Supervisor ready to have Run called on it.
+func NewSupervisor(binaryName string, watcher proxy.ConfigWatcher, bootstrap BootstrapFunc,
+	drainTime time.Duration, logger *log.Logger) *Supervisor {
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return &Supervisor{
+		BinaryName: binaryName,
+		DrainTime:  drainTime,
+		Watcher:    watcher,
+		Bootstrap:  bootstrap,
+		Logger:     logger,
+		epochs:     make(map[int]*runningEnvoy),
+	}
+}
+
+// Run blocks, starting a new Envoy epoch for every config delivered on
+// Watcher.Watch() and draining old epochs in the background, until stopCh is
+// closed. It returns once all known epochs have been signalled to stop. If
+// the Watch channel is closed instead, Run returns nil without signalling
+// any epoch, leaving the running Envoy processes in place.
+func (s *Supervisor) Run(stopCh <-chan struct{}) error {
+	for {
+		select {
+		case cfg, ok := <-s.Watcher.Watch():
+			if !ok {
+				return nil
+			}
+			if err := s.startEpoch(cfg); err != nil {
+				s.Logger.Printf("[ERR] envoy: failed to start new hot-restart epoch: %s", err)
+			}
+		case <-stopCh:
+			s.stopAll()
+			return nil
+		}
+	}
+}
+
+// Epochs returns the set of epoch numbers Supervisor currently believes are
+// live (started and not yet reaped). It exists primarily so tests can assert
+// on hot-restart behavior the same way FakeEnvoyExecData lets them assert on
+// a single exec.
+func (s *Supervisor) Epochs() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]int, 0, len(s.epochs))
+	for epoch := range s.epochs {
+		out = append(out, epoch)
+	}
+	return out
+}
+
+func (s *Supervisor) startEpoch(cfg *proxy.Config) error {
+	s.mu.Lock()
+	epoch := s.nextEpoch
+	s.nextEpoch++
+	previous := make([]*runningEnvoy, 0, len(s.epochs))
+	for _, re := range s.epochs {
+		previous = append(previous, re)
+	}
+	s.mu.Unlock()
+
+	bootstrapJson, err := s.Bootstrap(cfg, epoch)
+	if err != nil {
+		return fmt.Errorf("rendering bootstrap for epoch %d: %s", epoch, err)
+	}
+
+	restartArgs := []string{"--restart-epoch", strconv.Itoa(epoch)}
+	cmd, pipeR, pipeW, err := buildEnvoyCmd(s.BinaryName, s.CurArgs, restartArgs, s.ExtraArgs, bootstrapJson)
+	if err != nil {
+		return fmt.Errorf("preparing epoch %d: %s", epoch, err)
+	}
+
+	startErr := cmd.Start()
+	// The child has its own copy of the read end once Start returns (or
+	// never will, if Start failed), so our copy must be closed either way.
+	pipeR.Close()
+	if startErr != nil {
+		pipeW.Close()
+		return fmt.Errorf("starting epoch %d: %s", epoch, startErr)
+	}
+	feedBootstrap(pipeW, bootstrapJson)
+
+	s.Logger.Printf("[INFO] envoy: started hot-restart epoch %d", epoch)
+
+	re := &runningEnvoy{epoch: epoch, cmd: cmd.Process}
+	s.mu.Lock()
+	s.epochs[epoch] = re
+	s.mu.Unlock()
+
+	go s.reap(re, cmd)
+
+	for _, old := range previous {
+		old := old
+		time.AfterFunc(s.DrainTime, func() {
+			s.drain(old)
+		})
+	}
+
+	return nil
+}
+
+// reap removes an epoch's bookkeeping entry once its process has exited,
+// whether that's because we drained it or because it crashed on its own.
+func (s *Supervisor) reap(re *runningEnvoy, cmd *exec.Cmd) {
+	if err := cmd.Wait(); err != nil {
+		s.Logger.Printf("[WARN] envoy: epoch %d exited: %s", re.epoch, err)
+	} else {
+		s.Logger.Printf("[INFO] envoy: epoch %d exited", re.epoch)
+	}
+
+	s.mu.Lock()
+	delete(s.epochs, re.epoch)
+	s.mu.Unlock()
+}
+
+// drain sends SIGTERM to a previous epoch now that its replacement has had
+// DrainTime to take over its listening sockets and let existing connections
+// finish naturally.
+func (s *Supervisor) drain(re *runningEnvoy) {
+	s.Logger.Printf("[INFO] envoy: draining epoch %d", re.epoch)
+	if err := re.cmd.Signal(syscall.SIGTERM); err != nil {
+		s.Logger.Printf("[WARN] envoy: failed to signal epoch %d: %s", re.epoch, err)
+	}
+}
+
+func (s *Supervisor) stopAll() {
+	s.mu.Lock()
+	all := make([]*runningEnvoy, 0, len(s.epochs))
+	for _, re := range s.epochs {
+		all = append(all, re)
+	}
+	s.mu.Unlock()
+
+	for _, re := range all {
+		s.drain(re)
+	}
+}
@@ -0,0 +1,109 @@
+// +build linux darwin
+
+package envoy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/connect/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConfigWatcher lets a test drive Supervisor.Run with configs pushed by
+// hand rather than a real proxy.AgentConfigWatcher talking to an agent.
+type fakeConfigWatcher struct {
+	ch chan *proxy.Config
+}
+
+func newFakeConfigWatcher() *fakeConfigWatcher {
+	return &fakeConfigWatcher{ch: make(chan *proxy.Config)}
+}
+
+func (w *fakeConfigWatcher) Watch() <-chan *proxy.Config {
+	return w.ch
+}
+
+// TestSupervisorHotRestart verifies that Supervisor starts a new epoch for
+// every config pushed by the watcher and that the previous one is drained
+// and reaped after its replacement starts. It also checks, the same way TestExecEnvoy does for a single
+// execEnvoy call, that each fake-envoy child actually received and could
+// read back its bootstrap - this is what would have caught the epoch's
+// bootstrap pipe being closed before the child had a chance to inherit it.
+func TestSupervisorHotRestart(t *testing.T) {
+	require := require.New(t)
+
+	// buildEnvoyCmd hard-codes the child's stdout to os.Stdout, so swap it
+	// for a pipe for the duration of the test to capture what each
+	// fake-envoy epoch reports about its bootstrap.
+	origStdout := os.Stdout
+	outR, outW, err := os.Pipe()
+	require.NoError(err)
+	os.Stdout = outW
+	defer func() { os.Stdout = origStdout }()
+
+	got := make(chan FakeEnvoyExecData, 2)
+	go func() {
+		dec := json.NewDecoder(outR)
+		for {
+			var data FakeEnvoyExecData
+			if err := dec.Decode(&data); err != nil {
+				return
+			}
+			got <- data
+		}
+	}()
+
+	watcher := newFakeConfigWatcher()
+
+	sup := NewSupervisor(os.Args[0], watcher,
+		func(cfg *proxy.Config, epoch int) ([]byte, error) {
+			return []byte(fmt.Sprintf("%s-%d", fakeEnvoyTestData, epoch)), nil
+		},
+		50*time.Millisecond,
+		log.New(os.Stderr, "", log.LstdFlags))
+	sup.CurArgs = []string{"-test.run=TestHelperProcess", "--", helperProcessSentinel, "fake-envoy-block"}
+	sup.ExtraArgs = []string{"--fake-envoy-arg"}
+
+	stopCh := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- sup.Run(stopCh) }()
+
+	watcher.ch <- &proxy.Config{ProxiedServiceName: "web"}
+	require.Eventually(func() bool {
+		return len(sup.Epochs()) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal([]int{0}, sup.Epochs())
+
+	// Pushing a second config should bump the epoch while the first one is
+	// still draining.
+	watcher.ch <- &proxy.Config{ProxiedServiceName: "web", ProxiedServiceNamespace: "updated"}
+	require.Eventually(func() bool {
+		epochs := sup.Epochs()
+		return len(epochs) == 1 && epochs[0] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	close(stopCh)
+	require.NoError(<-done)
+	outW.Close()
+
+	// Both epochs' fake-envoy children must have actually inherited and
+	// read back their own bootstrap config, not just been bookkept.
+	var gotData []string
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-got:
+			gotData = append(gotData, data.ConfigData)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for fake-envoy epoch %d to report its bootstrap", i)
+		}
+	}
+	require.ElementsMatch([]string{
+		fmt.Sprintf("%s-0", fakeEnvoyTestData),
+		fmt.Sprintf("%s-1", fakeEnvoyTestData),
+	}, gotData)
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/connect"
+	"github.com/mitchellh/mapstructure"
+)
+
+// Config is the configuration for a proxy instance. It's populated from the
+// local agent's view of the proxy's service registration (the
+// "connect.proxy" config blob) by AgentConfigWatcher.
+type Config struct {
+	// ProxiedServiceName is the name of the service this proxy is fronting.
+	ProxiedServiceName string
+
+	// ProxiedServiceNamespace is the namespace of the service this proxy is
+	// fronting.
+	ProxiedServiceNamespace string
+
+	// PublicListener configures the mTLS listener that accepts inbound
+	// Connect traffic destined for the proxied service.
+	PublicListener PublicListenerConfig
+
+	// Upstreams configures the local listeners that accept plain TCP
+	// traffic from the proxied service and forward it over Connect to
+	// other services.
+	Upstreams []UpstreamConfig
+}
+
+// PublicListenerConfig configures the mTLS listener that Envoy or our
+// built-in proxy exposes for other Connect-enabled services to dial.
+type PublicListenerConfig struct {
+	// BindAddress is the address the public listener binds to.
+	BindAddress string `mapstructure:"bind_address"`
+
+	// BindPort is the port the public listener binds to.
+	BindPort int `mapstructure:"bind_port"`
+
+	// LocalServiceAddress is the host:port of the local application
+	// instance that accepts plain TCP traffic forwarded from the public
+	// listener.
+	LocalServiceAddress string `mapstructure:"local_service_address"`
+
+	// HandshakeTimeoutMs is how long to wait for a TLS handshake on the
+	// public listener before giving up on the connection.
+	HandshakeTimeoutMs int `mapstructure:"handshake_timeout_ms"`
+
+	// LocalConnectTimeoutMs is how long to wait when dialing
+	// LocalServiceAddress before giving up on the connection.
+	LocalConnectTimeoutMs int `mapstructure:"local_connect_timeout_ms"`
+
+	// DrainTimeoutMs is how long the public listener allows in-flight
+	// Connect sessions to finish after a SIGTERM/SIGINT or a SIGHUP
+	// fork/handoff before it stops waiting and the process exits.
+	DrainTimeoutMs int `mapstructure:"drain_timeout_ms"`
+}
+
+// DrainTimeout returns the configured drain timeout as a time.Duration,
+// defaulting to DefaultDrainTimeout when unset.
+func (p PublicListenerConfig) DrainTimeout() time.Duration {
+	if p.DrainTimeoutMs <= 0 {
+		return DefaultDrainTimeout
+	}
+	return time.Duration(p.DrainTimeoutMs) * time.Millisecond
+}
+
+// DefaultDrainTimeout is how long the public listener waits for in-flight
+// sessions to finish during a graceful drain if PublicListenerConfig doesn't
+// set DrainTimeoutMs explicitly.
+const DefaultDrainTimeout = 5 * time.Minute
+
+// UpstreamConfig configures a single upstream listener - a local TCP port
+// that forwards to another Connect-enabled service.
+type UpstreamConfig struct {
+	// DestinationType is one of "service" or "prepared_query".
+	DestinationType string `mapstructure:"destination_type"`
+
+	// DestinationNamespace is the namespace of the destination.
+	DestinationNamespace string `mapstructure:"destination_namespace"`
+
+	// DestinationName is the name of the service or prepared query to
+	// dial.
+	DestinationName string `mapstructure:"destination_name"`
+
+	// Datacenter is the datacenter to resolve the destination in. Defaults
+	// to the local datacenter.
+	Datacenter string `mapstructure:"datacenter"`
+
+	// LocalBindAddress is the address the upstream listener binds to.
+	LocalBindAddress string `mapstructure:"local_bind_address"`
+
+	// LocalBindPort is the port the upstream listener binds to.
+	LocalBindPort int `mapstructure:"local_bind_port"`
+
+	// ConnectTimeoutMs is how long to wait for the upstream connection to
+	// be established before giving up.
+	ConnectTimeoutMs int `mapstructure:"connect_timeout_ms"`
+}
+
+// applyDefaults fills in zero-valued fields of cfg with this package's
+// defaults in the same way the agent would for an un-configured managed
+// proxy.
+func applyDefaults(cfg *Config) {
+	if cfg.ProxiedServiceNamespace == "" {
+		cfg.ProxiedServiceNamespace = "default"
+	}
+	if cfg.PublicListener.LocalConnectTimeoutMs == 0 {
+		cfg.PublicListener.LocalConnectTimeoutMs = 1000
+	}
+	for i := range cfg.Upstreams {
+		u := &cfg.Upstreams[i]
+		if u.DestinationType == "" {
+			u.DestinationType = "service"
+		}
+		if u.DestinationNamespace == "" {
+			u.DestinationNamespace = "default"
+		}
+		if u.LocalBindAddress == "" {
+			u.LocalBindAddress = "127.0.0.1"
+		}
+	}
+}
+
+// ConfigWatcher is the interface implemented by things that can deliver a
+// stream of Config updates, such as AgentConfigWatcher.
+type ConfigWatcher interface {
+	// Watch returns a channel that yields a new *Config every time the
+	// underlying configuration changes. Implementations are expected to
+	// only ever have one value pending and to drop/coalesce updates that
+	// arrive faster than the consumer can read them.
+	Watch() <-chan *Config
+}
+
+// AgentConfigWatcher watches a local agent's managed proxy service
+// registration for config changes via the blocking query support in the
+// agent HTTP API's Service endpoint.
+type AgentConfigWatcher struct {
+	client    *api.Client
+	serviceID string
+	logger    *log.Logger
+	watchCh   chan *Config
+	stopCh    chan struct{}
+}
+
+// NewAgentConfigWatcher creates an AgentConfigWatcher that polls serviceID's
+// registration on client's agent for changes, decodes them into a Config,
+// and delivers them on the returned watcher's Watch() channel. The initial
+// fetch happens synchronously so callers get an immediate error if the
+// service isn't registered.
+func NewAgentConfigWatcher(client *api.Client, serviceID string, logger *log.Logger) (*AgentConfigWatcher, error) {
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	w := &AgentConfigWatcher{
+		client:    client,
+		serviceID: serviceID,
+		logger:    logger,
+		watchCh:   make(chan *Config, 1),
+		stopCh:    make(chan struct{}),
+	}
+
+	cfg, index, err := w.fetch(0)
+	if err != nil {
+		return nil, err
+	}
+	w.watchCh <- cfg
+
+	go w.watch(index)
+
+	return w, nil
+}
+
+// Watch implements ConfigWatcher.
+func (w *AgentConfigWatcher) Watch() <-chan *Config {
+	return w.watchCh
+}
+
+// Close stops the background watch goroutine.
+func (w *AgentConfigWatcher) Close() error {
+	close(w.stopCh)
+	return nil
+}
+
+func (w *AgentConfigWatcher) watch(lastIndex uint64) {
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		default:
+		}
+
+		cfg, index, err := w.fetch(lastIndex)
+		if err != nil {
+			w.logger.Printf("[ERR] proxy: error watching proxy config: %s", err)
+			select {
+			case <-time.After(time.Second):
+			case <-w.stopCh:
+				return
+			}
+			continue
+		}
+		lastIndex = index
+
+		if cfg == nil {
+			continue
+		}
+
+		select {
+		case w.watchCh <- cfg:
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+func (w *AgentConfigWatcher) fetch(lastIndex uint64) (*Config, uint64, error) {
+	raw, meta, err := w.client.Agent().Service(w.serviceID, &api.QueryOptions{
+		WaitIndex: lastIndex,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if raw.Connect == nil || raw.Connect.Proxy == nil {
+		return nil, meta.LastIndex, fmt.Errorf("service %q has no managed proxy config", w.serviceID)
+	}
+
+	var cfg Config
+	if err := mapstructure.Decode(raw.Connect.Proxy.Config, &cfg.PublicListener); err != nil {
+		return nil, meta.LastIndex, fmt.Errorf("failed decoding proxy config: %s", err)
+	}
+
+	cfg.ProxiedServiceName = raw.Proxy.TargetServiceName
+	cfg.ProxiedServiceNamespace = "default"
+
+	cfg.Upstreams = make([]UpstreamConfig, len(raw.Connect.Proxy.Upstreams))
+	for i, u := range raw.Connect.Proxy.Upstreams {
+		cfg.Upstreams[i] = UpstreamConfig{
+			DestinationType:      u.DestinationType,
+			DestinationNamespace: u.DestinationNamespace,
+			DestinationName:      u.DestinationName,
+			Datacenter:           u.Datacenter,
+			LocalBindAddress:     u.LocalBindAddress,
+			LocalBindPort:        u.LocalBindPort,
+		}
+	}
+
+	applyDefaults(&cfg)
+
+	return &cfg, meta.LastIndex, nil
+}
+
+// UpstreamResolverFuncFromClient returns a function that resolves an
+// UpstreamConfig into a connect.ConsulResolver using client to query Consul
+// for the upstream's instances. It exists so Upstream listeners can all
+// share one resolution strategy without depending on *api.Client directly
+// in tests.
+func UpstreamResolverFuncFromClient(client *api.Client) func(UpstreamConfig) (*connect.ConsulResolver, error) {
+	return func(cfg UpstreamConfig) (*connect.ConsulResolver, error) {
+		typ := connect.ConsulResolverTypeService
+		if cfg.DestinationType == "prepared_query" {
+			typ = connect.ConsulResolverTypePreparedQuery
+		}
+
+		return &connect.ConsulResolver{
+			Client:     client,
+			Namespace:  cfg.DestinationNamespace,
+			Name:       cfg.DestinationName,
+			Datacenter: cfg.Datacenter,
+			Type:       typ,
+		}, nil
+	}
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// inheritListenerEnvVar is set on a forked child's environment to tell it
+// which inherited file descriptor (passed via exec.Cmd.ExtraFiles) already
+// holds the public listener socket, so it can pick up where its parent left
+// off instead of binding a fresh port. This is the same fork-and-inherit
+// pattern long-lived proxies such as Airbnb's synapse/nutcracker wrappers
+// use for zero-downtime restarts.
+const inheritListenerEnvVar = "CONSUL_PROXY_LISTENER_FD"
+
+// Service runs the public mTLS listener for a single proxy instance and
+// knows how to gracefully drain, exit, or hand itself off to a forked child
+// in response to signals.
+type Service struct {
+	cfg    *Config
+	logger *log.Logger
+
+	listener *net.TCPListener
+
+	// ForkBinary and ForkArgs control what fork execs. They default to
+	// os.Args[0] and os.Args[1:] and are only exposed so tests can re-exec
+	// the test binary itself in place of a real proxy process.
+	ForkBinary string
+	ForkArgs   []string
+
+	mu     sync.Mutex
+	active sync.WaitGroup
+}
+
+// NewService creates a Service and binds its public listener. If the
+// process's environment carries inheritListenerEnvVar (set by a parent that
+// forked to hand off during a SIGHUP reload), the existing socket is
+// inherited via ExtraFiles instead of opening a new one so that no incoming
+// connections are dropped mid-handoff.
+func NewService(cfg *Config, logger *log.Logger) (*Service, error) {
+	s := &Service{
+		cfg:        cfg,
+		logger:     logger,
+		ForkBinary: os.Args[0],
+		ForkArgs:   os.Args[1:],
+	}
+
+	if fdStr := os.Getenv(inheritListenerEnvVar); fdStr != "" {
+		l, err := inheritListener(fdStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inherit listener fd %s: %s", fdStr, err)
+		}
+		s.listener = l
+		return s, nil
+	}
+
+	addr := fmt.Sprintf("%s:%d", cfg.PublicListener.BindAddress, cfg.PublicListener.BindPort)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.listener = l.(*net.TCPListener)
+	return s, nil
+}
+
+func inheritListener(fdStr string) (*net.TCPListener, error) {
+	var fd uintptr
+	if _, err := fmt.Sscanf(fdStr, "%d", &fd); err != nil {
+		return nil, fmt.Errorf("invalid fd %q: %s", fdStr, err)
+	}
+
+	f := os.NewFile(fd, "inherited-public-listener")
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	// The duplicate fd from FileListener means our copy can be closed now
+	// that the listener has its own.
+	f.Close()
+
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("inherited fd %d is not a TCP listener", fd)
+	}
+	return tl, nil
+}
+
+// Run accepts connections on the public listener and blocks handling
+// SIGHUP, SIGTERM/SIGINT and SIGUSR2 until the listener is closed by a
+// graceful shutdown. handle is invoked in its own goroutine for every
+// accepted connection and is expected to close conn when done; Run tracks
+// it as in-flight for the purposes of draining on shutdown.
+func (s *Service) Run(handle func(conn net.Conn)) error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	defer signal.Stop(sigCh)
+
+	acceptErrCh := make(chan error, 1)
+	go func() {
+		acceptErrCh <- s.acceptLoop(handle)
+	}()
+
+	for {
+		select {
+		case err := <-acceptErrCh:
+			return err
+
+		case sig := <-sigCh:
+			switch sig {
+			case syscall.SIGHUP:
+				s.logger.Printf("[INFO] proxy: SIGHUP received, forking and handing off listener")
+				if _, err := s.fork(); err != nil {
+					s.logger.Printf("[ERR] proxy: failed to fork on SIGHUP: %s", err)
+					continue
+				}
+				return s.drainAndClose()
+
+			case syscall.SIGUSR2:
+				s.logger.Printf("[INFO] proxy: SIGUSR2 received, forking without exiting")
+				if _, err := s.fork(); err != nil {
+					s.logger.Printf("[ERR] proxy: failed to fork on SIGUSR2: %s", err)
+				}
+
+			case syscall.SIGTERM, syscall.SIGINT:
+				s.logger.Printf("[INFO] proxy: %s received, draining", sig)
+				return s.drainAndClose()
+			}
+		}
+	}
+}
+
+func (s *Service) acceptLoop(handle func(conn net.Conn)) error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.active.Add(1)
+		go func() {
+			defer s.active.Done()
+			handle(conn)
+		}()
+	}
+}
+
+// drainAndClose stops accepting new connections and waits up to
+// Config.PublicListener.DrainTimeout for in-flight connections to finish
+// before returning.
+func (s *Service) drainAndClose() error {
+	s.mu.Lock()
+	l := s.listener
+	s.listener = nil
+	s.mu.Unlock()
+
+	if l == nil {
+		return nil
+	}
+	if err := l.Close(); err != nil {
+		return err
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		s.logger.Printf("[INFO] proxy: all connections drained")
+	case <-time.After(s.cfg.PublicListener.DrainTimeout()):
+		s.logger.Printf("[WARN] proxy: drain timeout exceeded, exiting with connections still active")
+	}
+	return nil
+}
+
+// fork execs a copy of the running binary with the same argv, passing the
+// public listener's file descriptor through ExtraFiles and
+// inheritListenerEnvVar so the child can adopt it instead of binding a new
+// port. The parent's own listener is left running until the caller decides
+// to drain and close it (SIGHUP) or to keep serving alongside the child
+// (SIGUSR2).
+func (s *Service) fork() (*os.Process, error) {
+	lf, err := s.listener.File()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get listener file: %s", err)
+	}
+	defer lf.Close()
+
+	cmd := exec.Command(s.ForkBinary, s.ForkArgs...)
+	cmd.ExtraFiles = []*os.File{lf}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=3", inheritListenerEnvVar))
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	s.logger.Printf("[INFO] proxy: forked child pid %d", cmd.Process.Pid)
+	return cmd.Process, nil
+}
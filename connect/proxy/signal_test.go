@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestServiceForkHandsOffListenerFD verifies that Service.fork passes the
+// public listener through as an inherited file descriptor and that a child
+// started with inheritListenerEnvVar set can adopt it via inheritListener,
+// the path NewService takes instead of binding a fresh port - the same FD-survives-an-exec check TestExecEnvoy
+// does for Envoy's bootstrap pipe, applied to our own fork/handoff.
+func TestServiceForkHandsOffListenerFD(t *testing.T) {
+	require := require.New(t)
+
+	cfg := &Config{
+		PublicListener: PublicListenerConfig{
+			BindAddress: "127.0.0.1",
+			BindPort:    0,
+		},
+	}
+	s, err := NewService(cfg, log.New(ioutil.Discard, "", 0))
+	require.NoError(err)
+	defer s.listener.Close()
+
+	s.ForkBinary = os.Args[0]
+	s.ForkArgs = []string{"-test.run=TestHelperProcess", "--", helperProcessSentinel, "report-fd"}
+
+	proc, err := s.fork()
+	require.NoError(err)
+
+	state, err := proc.Wait()
+	require.NoError(err)
+	require.True(state.Success())
+}
+
+// TestServiceDrainsOnTerm verifies that SIGTERM makes Service stop
+// accepting new connections and wait for the in-flight one to finish before
+// Run returns, and that it gives up once DrainTimeout elapses instead of
+// waiting forever.
+func TestServiceDrainsOnTerm(t *testing.T) {
+	tests := []struct {
+		name          string
+		handlerMode   string
+		drainTimeout  time.Duration
+		wantLogSubstr string
+	}{
+		{"connection finishes before deadline", "finish", time.Second, "all connections drained"},
+		{"deadline exceeded first", "stall", 50 * time.Millisecond, "drain timeout exceeded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+
+			cmd, destroy := helperProcessCmd("serve-and-drain", tt.handlerMode,
+				strconv.Itoa(int(tt.drainTimeout/time.Millisecond)))
+			defer destroy()
+
+			stdout, err := cmd.StdoutPipe()
+			require.NoError(err)
+			cmd.Stderr = os.Stderr
+			require.NoError(cmd.Start())
+
+			lines := bufio.NewScanner(stdout)
+			require.True(lines.Scan(), "expected subprocess to report its listener address")
+			addr := strings.TrimPrefix(lines.Text(), "LISTENING ")
+
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(err)
+			defer conn.Close()
+
+			// Wait for the subprocess to report that it actually accepted
+			// the connection: Service.Run registers its signal handling
+			// before it starts accepting, so this also guarantees SIGTERM
+			// won't race a handler that isn't installed yet (which would
+			// either kill the process outright or, if some other handler
+			// happened to already be registered for it, go unnoticed).
+			require.True(lines.Scan(), "expected subprocess to report accepting the connection")
+			require.Equal("ACCEPTED", lines.Text())
+
+			require.NoError(cmd.Process.Signal(syscall.SIGTERM))
+
+			var gotLog string
+			for lines.Scan() {
+				gotLog += lines.Text() + "\n"
+			}
+
+			require.NoError(cmd.Wait(), "subprocess log:\n%s", gotLog)
+			require.Contains(gotLog, tt.wantLogSubstr)
+		})
+	}
+}
+
+const helperProcessSentinel = "GO_WANT_HELPER_PROCESS"
+
+// helperProcessCmd returns an *exec.Cmd that re-execs the test binary into
+// TestHelperProcess with the given subcommand and args, mirroring the
+// pattern in command/connect/envoy's exec_test.go.
+func helperProcessCmd(s ...string) (*exec.Cmd, func()) {
+	cs := []string{"-test.run=TestHelperProcess", "--", helperProcessSentinel}
+	cs = append(cs, s...)
+
+	cmd := exec.Command(os.Args[0], cs...)
+	destroy := func() {
+		if p := cmd.Process; p != nil {
+			p.Kill()
+		}
+	}
+
+	return cmd, destroy
+}
+
+// TestHelperProcess is not a real test; it's a subprocess entry point used
+// by tests that need to exercise real exec/fork behavior, mirroring the
+// pattern in command/connect/envoy's exec_test.go.
+func TestHelperProcess(t *testing.T) {
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		args = args[1:]
+	}
+
+	if len(args) == 0 || args[0] != helperProcessSentinel {
+		return
+	}
+
+	defer os.Exit(0)
+	args = args[1:]
+	cmd := args[0]
+
+	switch cmd {
+	case "report-fd":
+		go time.AfterFunc(2*time.Minute, func() { os.Exit(99) })
+
+		fdStr := os.Getenv(inheritListenerEnvVar)
+		if fdStr == "" {
+			fmt.Fprintln(os.Stderr, "no inherited listener fd set")
+			os.Exit(1)
+		}
+
+		l, err := inheritListener(fdStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to inherit listener: %s\n", err)
+			os.Exit(1)
+		}
+		defer l.Close()
+
+		if _, ok := interface{}(l).(net.Listener); !ok {
+			fmt.Fprintln(os.Stderr, "inherited fd is not a net.Listener")
+			os.Exit(1)
+		}
+
+	case "serve-and-drain":
+		go time.AfterFunc(2*time.Minute, func() { os.Exit(99) })
+
+		handlerMode := args[1]
+		drainTimeoutMs, err := strconv.Atoi(args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid drain timeout %q: %s\n", args[2], err)
+			os.Exit(1)
+		}
+
+		cfg := &Config{
+			PublicListener: PublicListenerConfig{
+				BindAddress:    "127.0.0.1",
+				BindPort:       0,
+				DrainTimeoutMs: drainTimeoutMs,
+			},
+		}
+		s, err := NewService(cfg, log.New(os.Stdout, "", 0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to start service: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("LISTENING %s\n", s.listener.Addr())
+
+		handle := func(conn net.Conn) {
+			fmt.Println("ACCEPTED")
+			if handlerMode == "stall" {
+				time.Sleep(2 * time.Minute)
+			} else {
+				time.Sleep(50 * time.Millisecond)
+			}
+			conn.Close()
+		}
+
+		if err := s.Run(handle); err != nil {
+			fmt.Fprintf(os.Stderr, "Run returned error: %s\n", err)
+			os.Exit(1)
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %q\n", cmd)
+		os.Exit(2)
+	}
+}